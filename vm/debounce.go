@@ -0,0 +1,132 @@
+package vm
+
+// Program editors commonly write-then-rename, and config management systems
+// touch several files in one transaction; without coalescing, each of those
+// events would trigger its own compile and could pin CPU or flood
+// Prog_load_errors mid-transaction.  debouncer merges repeated watcher
+// events for the same path into a single reload, fired after a quiet window
+// and throttled by a leaky-bucket limiter similar to the one hpcloud/tail
+// uses to rate-limit its own output.
+
+import (
+	"expvar"
+	"flag"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+var (
+	Reload_debounce = flag.Duration("reload_debounce", 200*time.Millisecond, "Coalesce program reload events for the same file arriving within this window.")
+	Reload_rate     = flag.Float64("reload_rate", 10, "Maximum program compiles per second, enforced by a leaky-bucket limiter after debouncing.")
+
+	Prog_reloads_coalesced = expvar.NewInt("prog_reloads_coalesced_total")
+)
+
+// leakyBucket allows up to max compiles (at least one) to burst through,
+// then leaks tokens back in at rate per second.
+type leakyBucket struct {
+	mu     sync.Mutex
+	tokens float64
+	max    float64
+	rate   float64
+	last   time.Time
+}
+
+func newLeakyBucket(max int, rate float64) *leakyBucket {
+	if max < 1 {
+		max = 1
+	}
+	return &leakyBucket{tokens: float64(max), max: float64(max), rate: rate, last: time.Now()}
+}
+
+// allow reports whether a token is available and, if so, consumes it.
+func (b *leakyBucket) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.max {
+		b.tokens = b.max
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// retryAfter returns how long to wait for at least one token to refill,
+// for a caller that was just denied by allow.
+func (b *leakyBucket) retryAfter() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	need := 1 - b.tokens
+	if need <= 0 {
+		return 0
+	}
+	return time.Duration(need / b.rate * float64(time.Second))
+}
+
+// debouncer coalesces repeated calls for the same key arriving within a
+// window into a single eventual call, then throttles the surviving calls
+// through a leaky bucket.
+type debouncer struct {
+	window  time.Duration
+	limiter *leakyBucket
+
+	mu      sync.Mutex
+	pending map[string]*time.Timer
+}
+
+func newDebouncer(window time.Duration, limiter *leakyBucket) *debouncer {
+	return &debouncer{window: window, limiter: limiter, pending: make(map[string]*time.Timer)}
+}
+
+// schedule arranges for fn to run after the debounce window, unless another
+// schedule or flush for key arrives first, in which case the earlier timer
+// is cancelled; a cancellation by a later schedule is counted as coalesced.
+// If the leaky bucket denies a token when the window expires, fn is not
+// dropped: fire reschedules it to retry once the bucket has refilled, so the engine still
+// ends up in sync with the last event for key rather than stalling until
+// the next edit arrives.
+func (d *debouncer) schedule(key string, fn func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if t, ok := d.pending[key]; ok {
+		t.Stop()
+		Prog_reloads_coalesced.Add(1)
+	}
+	d.pending[key] = time.AfterFunc(d.window, func() { d.fire(key, fn) })
+}
+
+// fire runs fn if the leaky bucket allows it, or otherwise reschedules
+// itself to retry once the bucket has had time to refill a token.
+func (d *debouncer) fire(key string, fn func()) {
+	d.mu.Lock()
+	delete(d.pending, key)
+	d.mu.Unlock()
+
+	if d.limiter != nil && !d.limiter.allow() {
+		wait := d.limiter.retryAfter()
+		glog.Infof("Delaying reload of %q for %s, rate limit exceeded", key, wait)
+		d.mu.Lock()
+		d.pending[key] = time.AfterFunc(wait, func() { d.fire(key, fn) })
+		d.mu.Unlock()
+		return
+	}
+	fn()
+}
+
+// flush cancels any pending debounced reload for key without running it, for
+// use when the underlying file has just been deleted.
+func (d *debouncer) flush(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if t, ok := d.pending[key]; ok {
+		t.Stop()
+		delete(d.pending, key)
+	}
+}
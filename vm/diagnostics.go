@@ -0,0 +1,169 @@
+package vm
+
+// Diagnostics for loaded programs are retained here, keyed by program name,
+// so that an operator dashboard can render program health over HTTP instead
+// of scraping glog: this mirrors how LSP servers bundle diagnostics with
+// their fix locations.
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var Expose_bytecode *bool = flag.Bool("expose_bytecode", false, "Include bytecode disassembly in the /progz diagnostics endpoint.")
+
+// Diagnostic is a single parse or type error attached to a program, with
+// enough position information for an editor or dashboard to jump to the
+// offending source.
+type Diagnostic struct {
+	Line     int    `json:"line,omitempty"`
+	Column   int    `json:"column,omitempty"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+	Source   string `json:"source,omitempty"`
+}
+
+// progHealth is the diagnostic record kept for a single program across
+// reloads: the outcome of the most recent compile, and counters mirroring
+// the prog_loads_total/prog_load_errors expvars for that program alone.
+type progHealth struct {
+	Name            string       `json:"name"`
+	LastCompile     time.Time    `json:"last_compile"`
+	LastCompileOK   bool         `json:"last_compile_ok"`
+	LastSuccess     time.Time    `json:"last_success,omitempty"`
+	Diagnostics     []Diagnostic `json:"diagnostics,omitempty"`
+	Bytecode        string       `json:"bytecode,omitempty"`
+	LoadsTotal      int64        `json:"loads_total"`
+	LoadErrorsTotal int64        `json:"load_errors_total"`
+}
+
+// diagPos matches the "filename:line:col: message" form emitted by Compile's
+// errors, e.g. "foo.mtail:3:5: unexpected IDENTIFIER".
+var diagPos = regexp.MustCompile(`^([^:]+):(\d+):(\d+):\s*(.*)$`)
+
+// parseDiagnostic extracts position information from err and, if it names a
+// line found in src, attaches that line as the offending source excerpt.
+func parseDiagnostic(err error, src []byte) Diagnostic {
+	d := Diagnostic{Severity: "error", Message: err.Error()}
+	m := diagPos.FindStringSubmatch(err.Error())
+	if m == nil {
+		return d
+	}
+	d.Line, _ = strconv.Atoi(m[2])
+	d.Column, _ = strconv.Atoi(m[3])
+	d.Message = m[4]
+	if d.Line > 0 && src != nil {
+		lines := bytes.Split(src, []byte("\n"))
+		if d.Line-1 < len(lines) {
+			d.Source = strings.TrimRight(string(lines[d.Line-1]), "\r")
+		}
+	}
+	return d
+}
+
+func (p *progloader) healthFor(name string) *progHealth {
+	h, ok := p.health[name]
+	if !ok {
+		h = &progHealth{Name: name}
+		p.health[name] = h
+	}
+	return h
+}
+
+func (p *progloader) recordSuccess(name string, v *VM) {
+	// Capture bytecode before taking the lock: it can involve compiling a
+	// large program's disassembly, and must not hold up every other holder
+	// of p's mutex (Current, rootFor, ServeDiagnostics, ...) while it runs.
+	var bc string
+	if *Expose_bytecode {
+		bc = captureBytecode(v, name)
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	h := p.healthFor(name)
+	h.LastCompile = time.Now()
+	h.LastCompileOK = true
+	h.LastSuccess = h.LastCompile
+	h.Diagnostics = nil
+	h.LoadsTotal++
+	h.Bytecode = bc
+}
+
+func (p *progloader) recordFailure(name string, errs []error, src []byte) {
+	p.Lock()
+	defer p.Unlock()
+	h := p.healthFor(name)
+	h.LastCompile = time.Now()
+	h.LastCompileOK = false
+	h.LoadErrorsTotal++
+	diags := make([]Diagnostic, 0, len(errs))
+	for _, e := range errs {
+		diags = append(diags, parseDiagnostic(e, src))
+	}
+	h.Diagnostics = diags
+}
+
+// stdoutMu serializes captureBytecode calls, since DumpByteCode writes to
+// the process-global os.Stdout and two concurrent captures would each see
+// the other's output.
+var stdoutMu sync.Mutex
+
+// captureBytecode runs v.DumpByteCode, which writes its disassembly to
+// stdout, and returns what it printed rather than letting it reach the
+// process's actual stdout. The pipe is drained concurrently with the write
+// so that a disassembly larger than the pipe buffer can't deadlock
+// DumpByteCode against a reader that only starts after it returns.
+func captureBytecode(v *VM, name string) string {
+	stdoutMu.Lock()
+	defer stdoutMu.Unlock()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return ""
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+
+	done := make(chan string, 1)
+	go func() {
+		var buf bytes.Buffer
+		io.Copy(&buf, r)
+		done <- buf.String()
+	}()
+
+	v.DumpByteCode(name)
+
+	os.Stdout = stdout
+	w.Close()
+	return <-done
+}
+
+// ServeDiagnostics renders the current health of every known program as
+// JSON, for dashboards that would otherwise have to tail glog to find out
+// why a program stopped loading.
+func (p *progloader) ServeDiagnostics(w http.ResponseWriter, r *http.Request) {
+	p.RLock()
+	// Copy each progHealth by value while holding the lock: recordSuccess and
+	// recordFailure mutate these structs in place under p.Lock(), so encoding
+	// the pointed-to structs after RUnlock would race with them.
+	progs := make([]progHealth, 0, len(p.health))
+	for _, h := range p.health {
+		progs = append(progs, *h)
+	}
+	p.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(progs); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,255 @@
+package vm
+
+// Programs can share regex/const/decorator libraries with an
+//   include "shared/foo.mtail"
+// directive, which is expanded textually before the result reaches Compile.
+// progloader records the reverse dependency edge for every include it
+// expands, so that when the included file changes every program that
+// transitively includes it is recompiled together as a single snapshot
+// transition: a partial failure rejects the whole batch rather than leaving
+// the engine half loaded.
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/golang/glog"
+)
+
+var Include_path = flag.String("include_path", "", "Base directory under which included files may also be watched for changes; includes found under program_path are already watched, and includes found elsewhere are read but not watched unless they resolve under this path.")
+
+var includeDirective = regexp.MustCompile(`(?m)^\s*include\s+"([^"]+)"\s*\n?`)
+
+// expandIncludes resolves and inlines every include directive found in src,
+// recursively, recording each direct include edge against p's dependency
+// graph as it goes.  chain holds the keys of includers currently being
+// expanded, so a cycle is reported as a compile error rather than recursing
+// forever.
+func (p *progloader) expandIncludes(root, key string, src []byte, chain map[string]bool) ([]byte, error) {
+	if chain[key] {
+		return nil, fmt.Errorf("%s: include cycle detected", key)
+	}
+	chain[key] = true
+	defer delete(chain, key)
+
+	var out bytes.Buffer
+	last := 0
+	for _, m := range includeDirective.FindAllSubmatchIndex(src, -1) {
+		out.Write(src[last:m[0]])
+		last = m[1]
+
+		spec := string(src[m[2]:m[3]])
+		ipath, ikey, watch, err := p.resolveInclude(root, spec)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", key, err)
+		}
+		isrc, err := ioutil.ReadFile(ipath)
+		if err != nil {
+			return nil, fmt.Errorf("%s: include %q: %s", key, spec, err)
+		}
+		iexpanded, err := p.expandIncludes(root, ikey, isrc, chain)
+		if err != nil {
+			return nil, err
+		}
+		p.addDependency(ikey, key)
+		if watch {
+			p.w.Add(ipath)
+		}
+		out.Write(iexpanded)
+	}
+	out.Write(src[last:])
+	return out.Bytes(), nil
+}
+
+// resolveInclude finds the file spec refers to, relative to root first and
+// then, if not found there, under -include_path.  It also reports whether
+// the included file needs an explicit watch registered: files under root
+// are already picked up by the recursive directory watch, so only files
+// resolved under -include_path need one here.
+func (p *progloader) resolveInclude(root, spec string) (path, key string, watch bool, err error) {
+	candidate := filepath.Join(root, spec)
+	if _, serr := os.Stat(candidate); serr == nil {
+		return candidate, filepath.ToSlash(spec), false, nil
+	}
+	if *Include_path != "" {
+		candidate = filepath.Join(*Include_path, spec)
+		if _, serr := os.Stat(candidate); serr == nil {
+			key := "include:" + filepath.ToSlash(spec)
+			p.Lock()
+			if p.includeKeys == nil {
+				p.includeKeys = make(map[string]string)
+			}
+			p.includeKeys[candidate] = key
+			p.Unlock()
+			return candidate, key, true, nil
+		}
+	}
+	return "", "", false, fmt.Errorf("cannot resolve include %q", spec)
+}
+
+// includeKeyFor reports the dependency-graph key for a watched path that
+// was resolved under -include_path, if any.
+func (p *progloader) includeKeyFor(path string) (key string, ok bool) {
+	p.RLock()
+	defer p.RUnlock()
+	key, ok = p.includeKeys[path]
+	return
+}
+
+// scanIncludeTargets finds every include directive among the *.mtail files
+// under root, without compiling anything, and returns the set of
+// root-relative keys they name.  It is used to recognize, before loadDir
+// compiles anything, files that exist only to be included by another
+// program: a shared library of consts/decorators/regexes has nothing to
+// compile standalone, and walking it as its own program would reject the
+// whole batch it belongs to.
+func (p *progloader) scanIncludeTargets(root string) map[string]bool {
+	targets := make(map[string]bool)
+	filepath.Walk(root, func(pth string, fi os.FileInfo, werr error) error {
+		if werr != nil || fi.IsDir() || filepath.Ext(pth) != fileext {
+			return nil
+		}
+		src, err := ioutil.ReadFile(pth)
+		if err != nil {
+			return nil
+		}
+		for _, m := range includeDirective.FindAllSubmatch(src, -1) {
+			candidate := filepath.Join(root, string(m[1]))
+			if _, serr := os.Stat(candidate); serr != nil {
+				continue
+			}
+			rel, rerr := filepath.Rel(root, candidate)
+			if rerr != nil {
+				continue
+			}
+			targets[filepath.ToSlash(rel)] = true
+		}
+		return nil
+	})
+	return targets
+}
+
+// markIncludeOnly records keys as include targets so that isIncludeOnly can
+// later redirect watcher events on them to reloadDependents instead of
+// having loadDir or start try to compile them standalone.
+func (p *progloader) markIncludeOnly(keys map[string]bool) {
+	p.Lock()
+	defer p.Unlock()
+	for k := range keys {
+		p.includeOnly[k] = struct{}{}
+	}
+}
+
+// isIncludeOnly reports whether key was previously found to be the target
+// of an include directive from some program.  The set is shared by all
+// roots, so a key marked under one root is include-only under every root.
+func (p *progloader) isIncludeOnly(key string) bool {
+	p.RLock()
+	defer p.RUnlock()
+	_, ok := p.includeOnly[key]
+	return ok
+}
+
+// addDependency records that includerKey directly includes includedKey.
+func (p *progloader) addDependency(includedKey, includerKey string) {
+	p.Lock()
+	defer p.Unlock()
+	if p.dependents == nil {
+		p.dependents = make(map[string]map[string]struct{})
+	}
+	deps, ok := p.dependents[includedKey]
+	if !ok {
+		deps = make(map[string]struct{})
+		p.dependents[includedKey] = deps
+	}
+	deps[includerKey] = struct{}{}
+}
+
+// clearIncluderEdges removes includerKey from every included file's
+// dependent set, so that a recompile which drops an include doesn't leave a
+// stale edge behind.
+func (p *progloader) clearIncluderEdges(includerKey string) {
+	p.Lock()
+	defer p.Unlock()
+	for included, deps := range p.dependents {
+		delete(deps, includerKey)
+		if len(deps) == 0 {
+			delete(p.dependents, included)
+		}
+	}
+}
+
+// transitiveDependents returns every key that transitively includes key,
+// directly or indirectly.
+func (p *progloader) transitiveDependents(key string) []string {
+	p.RLock()
+	defer p.RUnlock()
+	seen := make(map[string]struct{})
+	var order []string
+	var walk func(string)
+	walk = func(k string) {
+		for dep := range p.dependents[k] {
+			if _, ok := seen[dep]; ok {
+				continue
+			}
+			seen[dep] = struct{}{}
+			order = append(order, dep)
+			walk(dep)
+		}
+	}
+	walk(key)
+	return order
+}
+
+// rootOf returns the root a previously compiled program key lives under.
+func (p *progloader) rootOf(key string) (root string, ok bool) {
+	p.RLock()
+	defer p.RUnlock()
+	root, ok = p.keyRoot[key]
+	return
+}
+
+// reloadDependents recompiles every program that transitively includes key
+// as a single snapshot transition: if any of them fails to compile, none of
+// them are installed and the previously live snapshot keeps serving.
+func (p *progloader) reloadDependents(key string) {
+	deps := p.transitiveDependents(key)
+	if len(deps) == 0 {
+		return
+	}
+
+	p.transMu.Lock()
+	defer p.transMu.Unlock()
+
+	good := p.currentSnapshot()
+	next := good.copy()
+
+	errors := 0
+	var compiled []string
+	for _, k := range deps {
+		root, ok := p.rootOf(k)
+		if !ok {
+			continue
+		}
+		if p.compileInto(next, root, k) > 0 {
+			errors++
+		} else {
+			compiled = append(compiled, k)
+		}
+	}
+
+	if errors > 0 {
+		glog.Infof("Rejecting reload of dependents of %q, keeping snapshot %d live: %s", key, good.id, diffEngines(good.e, next))
+		return
+	}
+	p.publish(next)
+	for _, k := range compiled {
+		Prog_loads.Add(k, 1)
+		p.recordSuccess(k, next[k])
+	}
+}
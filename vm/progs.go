@@ -5,14 +5,30 @@ package vm
 // created and deleted as well, and some configuration systems do an atomic
 // rename of the program when it is installed, so mtail is also aware of file
 // moves.
+//
+// Program sets are versioned: every successful load produces a new,
+// immutable snapshot of the full VM set rather than mutating the set in
+// place.  If any program in a batch fails to compile, the previous snapshot
+// is left serving traffic untouched, and the rejected attempt is logged as a
+// diff against it so operators can tell which program set is actually live.
+//
+// program_path may be a glob (e.g. "configs/*/mtail") as well as a plain
+// directory, and each matched directory is walked recursively: a watch is
+// registered on every subdirectory found, and a program's path relative to
+// its root becomes its VM name, so "sitea/http.mtail" and "siteb/http.mtail"
+// can coexist in the same engine.
 
 import (
+	"bytes"
 	"expvar"
 	"flag"
+	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
-	"path"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 
 	"github.com/golang/glog"
@@ -24,6 +40,8 @@ var (
 	Prog_loads       = expvar.NewMap("prog_loads_total")
 	Prog_load_errors = expvar.NewMap("prog_load_errors")
 
+	Prog_snapshot_id = expvar.NewInt("prog_snapshot_id")
+
 	Dump_bytecode *bool = flag.Bool("dump_bytecode", false, "Dump bytecode of programs and exit.")
 )
 
@@ -31,111 +49,438 @@ const (
 	fileext = ".mtail"
 )
 
-func (p *progloader) LoadProgs(program_path string) (*Engine, int) {
-	p.w.Add(program_path)
+// snapshot is an immutable, fully compiled set of VMs as of a point in time.
+// progloader never mutates a snapshot's Engine in place; a new snapshot is
+// built from a copy of the previous one and only published once every
+// program in the batch that produced it has compiled cleanly.
+type snapshot struct {
+	id int64
+	e  Engine
+}
 
-	fis, err := ioutil.ReadDir(program_path)
+// copy returns a new Engine containing the same VMs as s, so a caller can
+// apply additions and removals without disturbing s itself.
+func (s *snapshot) copy() Engine {
+	e := make(Engine, len(s.e))
+	for name, v := range s.e {
+		e[name] = v
+	}
+	return e
+}
+
+// LoadProgs expands program_path as a glob, recursively loads every *.mtail
+// program found under each match, and publishes the result as a new
+// snapshot.  If any program fails to compile, the whole batch is rejected
+// and the previously live snapshot keeps serving traffic.  The returned
+// *Engine is a point-in-time view taken at the end of this call; it does
+// not track later watcher-driven reloads, so long-lived callers on the
+// traffic-serving path should prefer Current(), which always re-reads the
+// live snapshot.
+func (p *progloader) LoadProgs(program_path string) (*Engine, int) {
+	matches, err := filepath.Glob(program_path)
 	if err != nil {
 		glog.Fatalf("Failed to list programs in %q: %s", program_path, err)
 	}
+	if len(matches) == 0 {
+		glog.Infof("No program directories matched %q", program_path)
+	}
+
+	p.transMu.Lock()
+	defer p.transMu.Unlock()
+
+	good := p.currentSnapshot()
+	next := good.copy()
 
 	errors := 0
-	for _, fi := range fis {
-		if fi.IsDir() {
+	var compiled []string
+	for _, root := range matches {
+		fi, serr := os.Stat(root)
+		if serr != nil {
+			glog.Infof("Failed to stat %q: %s", root, serr)
 			continue
 		}
-		if filepath.Ext(fi.Name()) != fileext {
+		if !fi.IsDir() {
+			glog.Infof("Skipping %q: not a directory", root)
 			continue
 		}
-		errors += p.LoadProg(program_path, fi.Name())
+		p.addRoot(root)
+		c, errs := p.loadDir(next, root, root)
+		compiled = append(compiled, c...)
+		errors += errs
+	}
+
+	if errors > 0 {
+		glog.Infof("Rejecting program set, keeping snapshot %d live: %s", good.id, diffEngines(good.e, next))
+		return &good.e, errors
 	}
-	return &p.E, errors
+
+	cur := p.publish(next)
+	// Only now that this batch's snapshot is actually live do its successes
+	// get recorded: a program that compiled cleanly but whose batch was
+	// rejected never ran, and must not look live in prog_loads_total/progz.
+	for _, key := range compiled {
+		Prog_loads.Add(key, 1)
+		p.recordSuccess(key, next[key])
+	}
+	return &cur.e, errors
 }
 
-func (p *progloader) LoadProg(program_path string, name string) (errors int) {
-	pth := path.Join(program_path, name)
-	f, err := os.Open(pth)
+// loadDir walks dir recursively, registering a watch on every subdirectory
+// it finds and compiling every *.mtail file into e, keyed by its path
+// relative to root, and reports which keys compiled cleanly.  dir and root
+// differ when a new subdirectory appears at runtime: root is still the
+// originally-watched base, dir is the new subtree being picked up.
+//
+// Before compiling anything it scans the whole of root for include
+// directives, so that a file which exists only to be included by another
+// program (a shared library of consts/decorators/regexes with nothing to
+// compile standalone) is not also walked and compiled as its own program.
+func (p *progloader) loadDir(e Engine, root, dir string) (compiled []string, errors int) {
+	includeOnly := p.scanIncludeTargets(root)
+	p.markIncludeOnly(includeOnly)
+
+	err := filepath.Walk(dir, func(pth string, fi os.FileInfo, werr error) error {
+		if werr != nil {
+			glog.Infof("Failed to walk %q: %s", pth, werr)
+			return nil
+		}
+		if fi.IsDir() {
+			p.w.Add(pth)
+			return nil
+		}
+		if filepath.Ext(pth) != fileext {
+			return nil
+		}
+		rel, rerr := filepath.Rel(root, pth)
+		if rerr != nil {
+			glog.Infof("Failed to relativize %q to %q: %s", pth, root, rerr)
+			return nil
+		}
+		key := filepath.ToSlash(rel)
+		if includeOnly[key] {
+			return nil
+		}
+		p.Lock()
+		p.pathnames[key] = struct{}{}
+		p.Unlock()
+		if p.compileInto(e, root, key) > 0 {
+			errors++
+		} else {
+			compiled = append(compiled, key)
+		}
+		return nil
+	})
 	if err != nil {
-		glog.Infof("Failed to read program %q: %s", pth, err)
-		errors = 1
-		Prog_load_errors.Add(name, 1)
+		glog.Infof("Failed to walk %q: %s", dir, err)
+	}
+	return
+}
+
+// LoadProg compiles a single program, named key relative to root, and if it
+// succeeds publishes a new snapshot derived from the current one with that
+// program's VM installed.  If compilation fails the current snapshot is left
+// untouched.
+func (p *progloader) LoadProg(root string, key string) (errors int) {
+	p.transMu.Lock()
+	defer p.transMu.Unlock()
+
+	good := p.currentSnapshot()
+	next := good.copy()
+
+	errors = p.compileInto(next, root, key)
+	if errors > 0 {
+		glog.Infof("Rejecting %q, keeping snapshot %d live: %s", key, good.id, diffEngines(good.e, next))
 		return
 	}
-	defer f.Close()
-	v, errs := Compile(name, f)
+
+	p.publish(next)
+	Prog_loads.Add(key, 1)
+	p.recordSuccess(key, next[key])
+	return
+}
+
+// compileInto reads and compiles the program at root/key, expanding any
+// include directives first, and on success installs its VM into e under
+// key.  It reports 1 and leaves e untouched on failure, recording the
+// program's diagnostics so they can be queried without tailing glog.
+//
+// compileInto does not record this compile as a success: callers compile a
+// whole batch into a candidate Engine before it is known whether the batch
+// as a whole will be published, so recording success here would credit a
+// program that never actually went live if a sibling in the same batch
+// later fails.  Callers record success themselves, for the keys that
+// survived, once p.publish has installed the new snapshot.
+func (p *progloader) compileInto(e Engine, root string, key string) (errors int) {
+	pth := filepath.Join(root, key)
+	src, err := ioutil.ReadFile(pth)
+	if err != nil {
+		glog.Infof("Failed to read program %q: %s", pth, err)
+		Prog_load_errors.Add(key, 1)
+		p.recordFailure(key, []error{err}, nil)
+		return 1
+	}
+
+	p.Lock()
+	p.keyRoot[key] = root
+	p.Unlock()
+	p.clearIncluderEdges(key)
+
+	expanded, err := p.expandIncludes(root, key, src, make(map[string]bool))
+	if err != nil {
+		glog.Infof("Failed to expand includes for %q: %s", pth, err)
+		Prog_load_errors.Add(key, 1)
+		p.recordFailure(key, []error{err}, src)
+		return 1
+	}
+
+	v, errs := Compile(key, bytes.NewReader(expanded))
 	if errs != nil {
-		errors = 1
 		for _, e := range errs {
 			glog.Info(e)
 		}
-		Prog_load_errors.Add(name, 1)
-		return
+		Prog_load_errors.Add(key, 1)
+		// expanded, not src: include directives shift line and column
+		// numbers, so the diagnostic's source excerpt must come from the
+		// buffer Compile actually saw, not the pre-expansion original.
+		p.recordFailure(key, errs, expanded)
+		return 1
 	}
 	if *Dump_bytecode {
-		v.DumpByteCode(name)
+		v.DumpByteCode(key)
 	}
-	p.E.AddVm(name, v)
-	Prog_loads.Add(name, 1)
-	return
+	e[key] = v
+	return 0
+}
+
+// diffEngines renders a short human-readable summary of the programs added,
+// removed, or changed between a good snapshot and a rejected candidate, for
+// logging alongside a rejected reload.
+func diffEngines(good, next Engine) string {
+	var added, removed, changed []string
+	for name, v := range next {
+		if old, ok := good[name]; !ok {
+			added = append(added, name)
+		} else if old != v {
+			changed = append(changed, name)
+		}
+	}
+	for name := range good {
+		if _, ok := next[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+
+	var parts []string
+	if len(added) > 0 {
+		parts = append(parts, fmt.Sprintf("+%s", strings.Join(added, ",+")))
+	}
+	if len(removed) > 0 {
+		parts = append(parts, fmt.Sprintf("-%s", strings.Join(removed, ",-")))
+	}
+	if len(changed) > 0 {
+		parts = append(parts, fmt.Sprintf("~%s", strings.Join(changed, ",~")))
+	}
+	if len(parts) == 0 {
+		return "(no change)"
+	}
+	return strings.Join(parts, " ")
 }
 
 type progloader struct {
 	sync.RWMutex
 	w         watcher.Watcher
 	pathnames map[string]struct{}
-	E         Engine
+	roots     []string
+	snap      *snapshot
+	health    map[string]*progHealth
+	debounce  *debouncer
+
+	// transMu serializes every snapshot transition (copy current -> compile
+	// into the copy -> publish) so that concurrent reloads, which now fire
+	// from independent debounce timers rather than a single goroutine,
+	// can't race to publish off the same base snapshot and silently drop
+	// one another's changes.
+	transMu sync.Mutex
+
+	keyRoot     map[string]string              // program/include key -> root directory
+	dependents  map[string]map[string]struct{} // include key -> direct includers
+	includeKeys map[string]string              // watched path -> include key, for -include_path files
+	includeOnly map[string]struct{}            // root-relative keys that are include targets, not standalone programs
 }
 
 func NewProgLoader(w watcher.Watcher) (p *progloader) {
 	p = &progloader{w: w,
-		E: make(map[string]*VM)}
+		snap:     &snapshot{id: 0, e: make(Engine)},
+		debounce: newDebouncer(*Reload_debounce, newLeakyBucket(int(*Reload_rate), *Reload_rate))}
 	p.Lock()
 	p.pathnames = make(map[string]struct{})
+	p.health = make(map[string]*progHealth)
+	p.keyRoot = make(map[string]string)
+	p.includeOnly = make(map[string]struct{})
 	p.Unlock()
 
+	http.HandleFunc("/progz", p.ServeDiagnostics)
+
 	go p.start()
 	return
 }
 
+// currentSnapshot returns the snapshot currently serving traffic.
+func (p *progloader) currentSnapshot() *snapshot {
+	p.RLock()
+	defer p.RUnlock()
+	return p.snap
+}
+
+// Current returns the Engine that is live right now.  Unlike the *Engine
+// returned by LoadProgs, which is frozen at the moment of that call, Current re-reads the live snapshot on every call, so a caller on
+// the log-processing hot path sees every watcher-driven reload by calling
+// this once per line rather than caching its result.
+func (p *progloader) Current() Engine {
+	return p.currentSnapshot().e
+}
+
+// publish installs next as the new live snapshot, numbered one past the
+// previous snapshot, and records the new snapshot ID in expvar.
+func (p *progloader) publish(next Engine) *snapshot {
+	p.Lock()
+	defer p.Unlock()
+	s := &snapshot{id: p.snap.id + 1, e: next}
+	p.snap = s
+	Prog_snapshot_id.Set(s.id)
+	return s
+}
+
+func (p *progloader) removeProg(name string) {
+	p.transMu.Lock()
+	defer p.transMu.Unlock()
+	good := p.currentSnapshot()
+	next := good.copy()
+	delete(next, name)
+	p.publish(next)
+}
+
+// addRoot records path as a base directory that LoadProgs has loaded, so
+// that watcher events arriving for files and subdirectories beneath it can
+// be resolved back to a root-relative VM name.
+func (p *progloader) addRoot(path string) {
+	p.Lock()
+	defer p.Unlock()
+	p.roots = append(p.roots, path)
+}
+
+// rootFor resolves an absolute path reported by the watcher back to the
+// root it was loaded under and the root-relative key that names its VM,
+// preferring the most specific (longest) matching root.
+func (p *progloader) rootFor(name string) (root, key string, ok bool) {
+	p.RLock()
+	defer p.RUnlock()
+	for _, r := range p.roots {
+		rel, err := filepath.Rel(r, name)
+		if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		if !ok || len(r) > len(root) {
+			root, key, ok = r, filepath.ToSlash(rel), true
+		}
+	}
+	return
+}
+
 func (p *progloader) start() {
 	for {
 		select {
 		case name := <-p.w.Deletes():
-			_, f := filepath.Split(name)
-			p.E.RemoveVm(f)
+			_, key, ok := p.rootFor(name)
+			if !ok {
+				_, key = filepath.Split(name)
+			}
+			p.debounce.flush(key)
+			p.removeProg(key)
 			p.Lock()
-			delete(p.pathnames, f)
+			delete(p.pathnames, key)
 			p.Unlock()
 			if err := p.w.Remove(name); err != nil {
 				glog.Info("Remove watch failed:", err)
 			}
 
 		case name := <-p.w.Creates():
+			if fi, err := os.Stat(name); err == nil && fi.IsDir() {
+				root, _, ok := p.rootFor(name)
+				if !ok {
+					continue
+				}
+				p.transMu.Lock()
+				good := p.currentSnapshot()
+				next := good.copy()
+				compiled, errors := p.loadDir(next, root, name)
+				if errors > 0 {
+					glog.Infof("Rejecting new directory %q, keeping snapshot %d live: %s", name, good.id, diffEngines(good.e, next))
+				} else {
+					p.publish(next)
+					for _, key := range compiled {
+						Prog_loads.Add(key, 1)
+						p.recordSuccess(key, next[key])
+					}
+				}
+				p.transMu.Unlock()
+				continue
+			}
 			if filepath.Ext(name) != fileext {
 				continue
 			}
-			d, f := filepath.Split(name)
-
+			if key, ok := p.includeKeyFor(name); ok {
+				p.debounce.schedule(key, func() { p.reloadDependents(key) })
+				continue
+			}
+			root, key, ok := p.rootFor(name)
+			if !ok {
+				continue
+			}
+			if p.isIncludeOnly(key) {
+				p.debounce.schedule(key, func() { p.reloadDependents(key) })
+				continue
+			}
 			p.Lock()
-			if _, ok := p.pathnames[f]; !ok {
-				p.pathnames[f] = struct{}{}
+			if _, ok := p.pathnames[key]; !ok {
+				p.pathnames[key] = struct{}{}
 				p.w.Add(name)
 			}
 			p.Unlock()
-			p.LoadProg(d, f)
+			p.debounce.schedule(key, func() {
+				p.LoadProg(root, key)
+				p.reloadDependents(key)
+			})
+
 		case name := <-p.w.Updates():
 			if filepath.Ext(name) != fileext {
 				continue
 			}
-			d, f := filepath.Split(name)
-
+			if key, ok := p.includeKeyFor(name); ok {
+				p.debounce.schedule(key, func() { p.reloadDependents(key) })
+				continue
+			}
+			root, key, ok := p.rootFor(name)
+			if !ok {
+				continue
+			}
+			if p.isIncludeOnly(key) {
+				p.debounce.schedule(key, func() { p.reloadDependents(key) })
+				continue
+			}
 			p.Lock()
-			if _, ok := p.pathnames[f]; !ok {
-				p.pathnames[f] = struct{}{}
+			if _, ok := p.pathnames[key]; !ok {
+				p.pathnames[key] = struct{}{}
 				p.w.Add(name)
 			}
 			p.Unlock()
-			p.LoadProg(d, f)
+			p.debounce.schedule(key, func() {
+				p.LoadProg(root, key)
+				p.reloadDependents(key)
+			})
 		}
 	}
 }